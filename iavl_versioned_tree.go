@@ -2,6 +2,7 @@ package iavl
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/pkg/errors"
 	dbm "github.com/tendermint/tmlibs/db"
@@ -9,12 +10,46 @@ import (
 
 var ErrVersionDoesNotExist = fmt.Errorf("version does not exist")
 
+// ImmutableTree is a read-only handle on a saved tree version. It shares
+// underlying nodes with the VersionedTree it was obtained from but does not
+// require holding the tree's lock to use, so query traffic can run
+// concurrently with a writer mutating the working tree; node reads and
+// writes to the shared ndb are expected to be internally synchronized by
+// nodeDB itself, independent of VersionedTree.mu.
+//
+// An ImmutableTree is only valid as long as its version is not removed out
+// from under it: callers must not retain one across a DeleteVersion or
+// LoadVersion call that drops the version it was taken from, since the
+// underlying nodes may be garbage collected from ndb once nothing
+// references that version any more.
+type ImmutableTree = IAVLTree
+
 // VersionedTree is a persistent tree which keeps track of versions.
+//
+// mu guards the versions map, latestVersion and the orphaningTree pointer
+// itself (the swap done by SaveVersion, Rollback, Load and LoadVersion), and
+// every method that touches them takes it. The working tree is reached
+// through the embedded *orphaningTree, so Set, Remove and Get - promoted
+// from it - are not covered by mu: the working tree is single-writer and
+// callers must not call them concurrently with each other or with another
+// goroutine reading tree.Tree()'s result, same as the bare IAVLTree they
+// wrap.
 type VersionedTree struct {
+	mu sync.RWMutex
+
 	*orphaningTree                           // The current, working tree.
 	versions       map[uint64]*orphaningTree // The previous, saved versions of the tree.
 	latestVersion  uint64                    // The latest saved version.
 	ndb            *nodeDB
+
+	keepRecent uint64 // Number of recent versions to keep, 0 disables the window.
+	keepEvery  uint64 // Interval of waypoint versions to retain forever, 0 disables waypoints.
+
+	// pruningEnabled is set only by NewVersionedTreeWithPruning. It, not
+	// keepRecent/keepEvery being zero, is what pruneVersions checks, since
+	// keepRecent == 0 && keepEvery == 0 is itself a valid pruning
+	// configuration (keep only the latest version).
+	pruningEnabled bool
 }
 
 // NewVersionedTree returns a new tree with the specified cache size and datastore.
@@ -29,19 +64,73 @@ func NewVersionedTree(cacheSize int, db dbm.DB) *VersionedTree {
 	}
 }
 
+// NewVersionedTreeWithPruning returns a new tree that automatically prunes
+// old versions as they are saved, keeping only the most recent keepRecent
+// versions plus any waypoint version (one where version % keepEvery == 0).
+//
+// The latest saved version is always kept. keepRecent == 0 means no
+// recent-window retention (only the latest version and waypoints, if any,
+// survive); keepEvery == 0 means no waypoints are retained.
+func NewVersionedTreeWithPruning(cacheSize int, db dbm.DB, keepRecent, keepEvery uint64) *VersionedTree {
+	tree := NewVersionedTree(cacheSize, db)
+	tree.keepRecent = keepRecent
+	tree.keepEvery = keepEvery
+	tree.pruningEnabled = true
+	return tree
+}
+
+// isWaypoint returns whether version should be retained forever under the
+// configured waypoint interval.
+func (tree *VersionedTree) isWaypoint(version uint64) bool {
+	return tree.keepEvery > 0 && version%tree.keepEvery == 0
+}
+
+// pruneVersions deletes every saved version that has fallen outside the
+// sliding window [latest-keepRecent+1, latest] and is not a waypoint. It is
+// called automatically by SaveVersion, with the lock already held.
+func (tree *VersionedTree) pruneVersions(latest uint64) {
+	if !tree.pruningEnabled {
+		return
+	}
+
+	var cutoff uint64
+	if latest > tree.keepRecent {
+		cutoff = latest - tree.keepRecent
+	}
+
+	for version := range tree.versions {
+		if version > cutoff || version == latest {
+			continue
+		}
+		if tree.isWaypoint(version) {
+			continue
+		}
+		// Already-pruned or otherwise missing versions are ignored: deleteVersion
+		// only errors on version 0, the latest version, or a version we don't
+		// have, none of which apply here.
+		_ = tree.deleteVersion(version)
+	}
+}
+
 // LatestVersion returns the latest saved version of the tree.
 func (tree *VersionedTree) LatestVersion() uint64 {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
 	return tree.latestVersion
 }
 
 // VersionExists returns whether or not a version exists.
 func (tree *VersionedTree) VersionExists(version uint64) bool {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
 	_, ok := tree.versions[version]
 	return ok
 }
 
 // Tree returns the current working tree.
 func (tree *VersionedTree) Tree() *IAVLTree {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
 	return tree.orphaningTree.IAVLTree
 }
 
@@ -52,6 +141,9 @@ func (tree *VersionedTree) String() string {
 
 // Load a versioned tree from disk. All tree versions are loaded automatically.
 func (tree *VersionedTree) Load() error {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
 	roots, err := tree.ndb.getRoots()
 	if err != nil {
 		return err
@@ -79,15 +171,36 @@ func (tree *VersionedTree) Load() error {
 func (tree *VersionedTree) GetVersioned(key []byte, version uint64) (
 	index int, value []byte, exists bool,
 ) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
 	if t, ok := tree.versions[version]; ok {
 		return t.Get(key)
 	}
 	return -1, nil, false
 }
 
+// Snapshot returns a read-only handle on the tree as of version, which can be
+// queried (Get, GetWithProof, range proofs, ...) without holding the
+// VersionedTree's lock. This lets query traffic run in parallel with a writer
+// calling Set, Remove or SaveVersion on the working tree.
+func (tree *VersionedTree) Snapshot(version uint64) (*ImmutableTree, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
+	t, ok := tree.versions[version]
+	if !ok {
+		return nil, errors.WithStack(ErrVersionDoesNotExist)
+	}
+	return t.IAVLTree, nil
+}
+
 // SaveVersion saves a new tree version to disk, based on the current state of
 // the tree. Multiple calls to SaveVersion with the same version are not allowed.
 func (tree *VersionedTree) SaveVersion(version uint64) ([]byte, error) {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
 	if _, ok := tree.versions[version]; ok {
 		return nil, errors.Errorf("version %d was already saved", version)
 	}
@@ -111,12 +224,22 @@ func (tree *VersionedTree) SaveVersion(version uint64) ([]byte, error) {
 	tree.ndb.SaveRoot(tree.root, version)
 	tree.ndb.Commit()
 
+	tree.pruneVersions(version)
+
 	return tree.root.hash, nil
 }
 
 // DeleteVersion deletes a tree version from disk. The version can then no
 // longer be accessed.
 func (tree *VersionedTree) DeleteVersion(version uint64) error {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	return tree.deleteVersion(version)
+}
+
+// deleteVersion is DeleteVersion without locking, for use by callers that
+// already hold tree.mu.
+func (tree *VersionedTree) deleteVersion(version uint64) error {
 	if version == 0 {
 		return errors.New("version must be greater than 0")
 	}
@@ -135,10 +258,56 @@ func (tree *VersionedTree) DeleteVersion(version uint64) error {
 	return nil
 }
 
+// Rollback discards all uncommitted mutations on the working tree, resetting
+// it to a clone of the latest saved version. To go back to an earlier saved
+// version, use LoadVersion.
+func (tree *VersionedTree) Rollback() {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	if saved, ok := tree.versions[tree.latestVersion]; ok {
+		tree.orphaningTree = saved.Clone()
+		return
+	}
+	// No version has been saved yet: discard all working-tree mutations by
+	// starting over from an empty tree.
+	tree.orphaningTree = newOrphaningTree(&IAVLTree{ndb: tree.ndb})
+}
+
+// LoadVersion discards every saved version strictly greater than
+// targetVersion, removing their roots and orphans from the backing store,
+// and resets the working tree to a clone of targetVersion. This lets a
+// consensus engine reorg to an earlier height without destroying the tree.
+func (tree *VersionedTree) LoadVersion(targetVersion uint64) error {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	if _, ok := tree.versions[targetVersion]; !ok {
+		return errors.WithStack(ErrVersionDoesNotExist)
+	}
+
+	for version := range tree.versions {
+		if version <= targetVersion {
+			continue
+		}
+		tree.ndb.DeleteVersion(version)
+		delete(tree.versions, version)
+	}
+	tree.ndb.Commit()
+
+	tree.latestVersion = targetVersion
+	tree.orphaningTree = tree.versions[targetVersion].Clone()
+
+	return nil
+}
+
 // GetVersionedWithProof gets the value under the key at the specified version
 // if it exists, or returns nil.  A proof of existence or absence is returned
 // alongside the value.
 func (tree *VersionedTree) GetVersionedWithProof(key []byte, version uint64) ([]byte, KeyProof, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
 	if t, ok := tree.versions[version]; ok {
 		return t.GetWithProof(key)
 	}
@@ -150,6 +319,9 @@ func (tree *VersionedTree) GetVersionedWithProof(key []byte, version uint64) ([]
 //
 // Returns a list of keys, a list of values and a proof.
 func (tree *VersionedTree) GetVersionedRangeWithProof(startKey, endKey []byte, limit int, version uint64) ([][]byte, [][]byte, *KeyRangeProof, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
 	if t, ok := tree.versions[version]; ok {
 		return t.GetRangeWithProof(startKey, endKey, limit)
 	}
@@ -159,6 +331,9 @@ func (tree *VersionedTree) GetVersionedRangeWithProof(startKey, endKey []byte, l
 // GetVersionedFirstInRangeWithProof gets the first key/value pair in the
 // specified range, with a proof.
 func (tree *VersionedTree) GetVersionedFirstInRangeWithProof(startKey, endKey []byte, version uint64) ([]byte, []byte, *KeyFirstInRangeProof, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
 	if t, ok := tree.versions[version]; ok {
 		return t.GetFirstInRangeWithProof(startKey, endKey)
 	}
@@ -168,8 +343,11 @@ func (tree *VersionedTree) GetVersionedFirstInRangeWithProof(startKey, endKey []
 // GetVersionedLastInRangeWithProof gets the last key/value pair in the
 // specified range, with a proof.
 func (tree *VersionedTree) GetVersionedLastInRangeWithProof(startKey, endKey []byte, version uint64) ([]byte, []byte, *KeyLastInRangeProof, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
 	if t, ok := tree.versions[version]; ok {
 		return t.GetLastInRangeWithProof(startKey, endKey)
 	}
 	return nil, nil, nil, errors.WithStack(ErrVersionDoesNotExist)
-}
\ No newline at end of file
+}
@@ -0,0 +1,230 @@
+package iavl
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Iterator defines an interface for iterating over a domain of key/value
+// pairs in ascending or descending order.
+type Iterator interface {
+	// Domain returns the start (inclusive) and end (exclusive) bounds of the
+	// iterator's range. Either may be nil, meaning unbounded.
+	Domain() (start []byte, end []byte)
+
+	// Valid returns whether the iterator is positioned at a valid key/value
+	// pair. Once Valid returns false, the iterator is exhausted.
+	Valid() bool
+
+	// Next advances the iterator to the next key in the iteration order.
+	// It is a no-op if the iterator is no longer Valid.
+	Next()
+
+	// Key returns the key at the current position. Panics if !Valid().
+	Key() []byte
+
+	// Value returns the value at the current position. Panics if !Valid().
+	Value() []byte
+
+	// Close releases any resources held by the iterator.
+	Close()
+}
+
+// IteratorVersioned returns an Iterator over the [start, end) domain of the
+// tree as of version, in ascending or descending key order. Children are
+// loaded from the backing store lazily as the iterator descends, and whole
+// subtrees known to fall outside [start, end) are never descended into, so
+// streaming a small range out of a large historical version costs
+// O(range + depth) rather than O(n).
+//
+// The returned Iterator holds tree's read lock for its entire lifetime, so a
+// concurrent DeleteVersion or LoadVersion cannot remove the version it is
+// reading out from under it. Callers must call Close when done with the
+// iterator - including on every early-exit path - or a writer (SaveVersion,
+// DeleteVersion, LoadVersion, Load, ImportVersion) will block forever
+// waiting for the lock.
+func (tree *VersionedTree) IteratorVersioned(start, end []byte, ascending bool, version uint64) (Iterator, error) {
+	tree.mu.RLock()
+
+	t, ok := tree.versions[version]
+	if !ok {
+		tree.mu.RUnlock()
+		return nil, errors.WithStack(ErrVersionDoesNotExist)
+	}
+
+	it := &versionedIterator{
+		mu:        &tree.mu,
+		ndb:       tree.ndb,
+		start:     start,
+		end:       end,
+		ascending: ascending,
+	}
+	it.descend(t.root)
+	it.advance()
+
+	return it, nil
+}
+
+// versionedIterator walks a saved IAVLNode tree with an explicit stack,
+// loading children through ndb on demand rather than requiring the whole
+// subtree to be resident in memory. It holds mu (the owning VersionedTree's
+// lock) read-locked from construction until Close.
+type versionedIterator struct {
+	mu        *sync.RWMutex
+	closed    bool
+	ndb       *nodeDB
+	start     []byte
+	end       []byte
+	ascending bool
+
+	stack []*IAVLNode
+	key   []byte
+	value []byte
+	valid bool
+}
+
+func (it *versionedIterator) Domain() ([]byte, []byte) {
+	return it.start, it.end
+}
+
+func (it *versionedIterator) Valid() bool {
+	return it.valid
+}
+
+func (it *versionedIterator) Key() []byte {
+	if !it.valid {
+		panic("iterator is not valid")
+	}
+	return it.key
+}
+
+func (it *versionedIterator) Value() []byte {
+	if !it.valid {
+		panic("iterator is not valid")
+	}
+	return it.value
+}
+
+func (it *versionedIterator) Close() {
+	if it.closed {
+		return
+	}
+	it.closed = true
+	it.stack = nil
+	it.valid = false
+	it.mu.RUnlock()
+}
+
+func (it *versionedIterator) Next() {
+	if !it.valid {
+		return
+	}
+	it.advance()
+}
+
+// prune reports, for an inner node, whether its left and/or right subtree is
+// entirely outside [start, end) and so can be skipped. node.key is the
+// smallest key in node's right subtree (and therefore an exclusive upper
+// bound on its left subtree), which is what makes this a cheap, purely
+// local decision at every inner node on the way down.
+func (it *versionedIterator) prune(node *IAVLNode) (skipLeft, skipRight bool) {
+	skipLeft = it.start != nil && bytes.Compare(it.start, node.key) >= 0
+	skipRight = it.end != nil && bytes.Compare(node.key, it.end) >= 0
+	return skipLeft, skipRight
+}
+
+// descend pushes node and its spine of "first" children (left children when
+// ascending, right children when descending) onto the stack, loading
+// unresolved children from ndb as needed, and skipping straight past any
+// subtree that prune reports is wholly outside [start, end). The node left
+// on top of the stack afterwards, if any, is always a leaf.
+func (it *versionedIterator) descend(node *IAVLNode) {
+	for node != nil {
+		if node.height == 0 {
+			it.stack = append(it.stack, node)
+			return
+		}
+
+		skipLeft, skipRight := it.prune(node)
+		if skipLeft && skipRight {
+			return
+		}
+
+		if it.ascending {
+			if skipLeft {
+				node = it.loadChild(node.rightNode, node.rightHash)
+				continue
+			}
+			it.stack = append(it.stack, node)
+			node = it.loadChild(node.leftNode, node.leftHash)
+		} else {
+			if skipRight {
+				node = it.loadChild(node.leftNode, node.leftHash)
+				continue
+			}
+			it.stack = append(it.stack, node)
+			node = it.loadChild(node.rightNode, node.rightHash)
+		}
+	}
+}
+
+func (it *versionedIterator) loadChild(child *IAVLNode, hash []byte) *IAVLNode {
+	if child != nil {
+		return child
+	}
+	if len(hash) == 0 {
+		return nil
+	}
+	return it.ndb.GetNode(hash)
+}
+
+// advance pops the stack until it lands on the next leaf within [start, end),
+// descending into the "other" subtree of every inner node it passes through
+// (again pruned by prune), and stops once the stack is exhausted - which
+// happens as soon as every remaining subtree falls outside the domain, so
+// the scan never runs past the far bound.
+func (it *versionedIterator) advance() {
+	for len(it.stack) > 0 {
+		node := it.stack[len(it.stack)-1]
+		it.stack = it.stack[:len(it.stack)-1]
+
+		if node.height > 0 {
+			skipLeft, skipRight := it.prune(node)
+			if it.ascending {
+				if !skipRight {
+					it.descend(it.loadChild(node.rightNode, node.rightHash))
+				}
+			} else {
+				if !skipLeft {
+					it.descend(it.loadChild(node.leftNode, node.leftHash))
+				}
+			}
+			continue
+		}
+
+		if !it.inDomain(node.key) {
+			continue
+		}
+
+		it.key = node.key
+		it.value = node.value
+		it.valid = true
+		return
+	}
+
+	it.key = nil
+	it.value = nil
+	it.valid = false
+}
+
+func (it *versionedIterator) inDomain(key []byte) bool {
+	if it.start != nil && bytes.Compare(key, it.start) < 0 {
+		return false
+	}
+	if it.end != nil && bytes.Compare(key, it.end) >= 0 {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,472 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// MultiProofInnerNode is one deduplicated inner node shared by one or more
+// key paths in a MultiKeyProof. Its hash is H(Height, Size, Version, Left,
+// Right) - see hashInnerNode.
+type MultiProofInnerNode struct {
+	Height  int8
+	Size    int64
+	Version uint64
+	Left    []byte
+	Right   []byte
+}
+
+// MultiProofLeafRef identifies one leaf referenced by a MultiKeyProof: its
+// key, value and version (needed to recompute the leaf's hash - see
+// hashLeafNode), plus the root-to-leaf path authenticating it, expressed as
+// indices into MultiKeyProof.InnerNodes. Directions holds, for each step of
+// Path, which child was taken to continue toward the leaf (true = left,
+// false = right); it is what lets Verify check that two leaves are
+// tree-adjacent rather than just key-ordered.
+type MultiProofLeafRef struct {
+	Key        []byte
+	Value      []byte
+	Version    uint64
+	Path       []int
+	Directions []bool
+}
+
+// MultiProofLeaf describes the result of looking up a single key within a
+// MultiKeyProof.
+//
+// When Exists is true, Leaf is the leaf at Key, and its hash chains through
+// Path to RootHash.
+//
+// When Exists is false, Key was not found. Absence is proven by the pair
+// (Pred, Succ): the leaf immediately before Key and the leaf immediately
+// after it in sorted order, each chaining to RootHash, together with proof
+// (via Directions) that they are tree-adjacent - i.e. that no leaf sits
+// between them - rather than merely two arbitrary leaves that bracket Key by
+// key comparison alone. Either may be nil if Key is smaller, or larger, than
+// every key in the tree.
+type MultiProofLeaf struct {
+	Key    []byte
+	Exists bool
+
+	Leaf *MultiProofLeafRef
+
+	Pred *MultiProofLeafRef
+	Succ *MultiProofLeafRef
+}
+
+// MultiKeyProof authenticates the values (or absence) of many keys at once
+// against a single root hash. Inner nodes shared by more than one key's path
+// are stored once in InnerNodes and referenced by index from each
+// MultiProofLeafRef.Path, so the proof's wire size scales with the tree's
+// cover of the query set rather than len(keys) * log(n).
+type MultiKeyProof struct {
+	RootHash   []byte
+	InnerNodes []MultiProofInnerNode
+	Leaves     []MultiProofLeaf
+}
+
+// GetVersionedMultiWithProof gets the values under keys at the specified
+// version, along with a single MultiKeyProof authenticating all of them
+// against one root hash.
+//
+// The whole lookup runs under tree's read lock, so a concurrent
+// DeleteVersion or LoadVersion cannot remove the version being read out from
+// under it.
+func (tree *VersionedTree) GetVersionedMultiWithProof(keys [][]byte, version uint64) ([][]byte, *MultiKeyProof, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
+	t, ok := tree.versions[version]
+	if !ok {
+		return nil, nil, errors.WithStack(ErrVersionDoesNotExist)
+	}
+
+	proof := &MultiKeyProof{}
+	if t.root != nil {
+		proof.RootHash = t.root.hash
+	}
+
+	// nodeIndex gives each distinct inner node (identified by its hash) a
+	// stable index the first time any key's path touches it, so ancestors
+	// shared across keys are emitted into InnerNodes only once.
+	nodeIndex := map[string]int{}
+
+	values := make([][]byte, len(keys))
+	proof.Leaves = make([]MultiProofLeaf, len(keys))
+
+	for i, key := range keys {
+		leaf, path, dirs := searchExact(t.IAVLTree, key, nodeIndex, proof)
+		if leaf != nil {
+			values[i] = leaf.value
+			proof.Leaves[i] = MultiProofLeaf{
+				Key:    key,
+				Exists: true,
+				Leaf:   newLeafRef(leaf, path, dirs),
+			}
+			continue
+		}
+
+		predLeaf, predPath, predDirs := predecessor(t.ndb, t.root, key, nodeIndex, proof)
+		succLeaf, succPath, succDirs := successor(t.ndb, t.root, key, nodeIndex, proof)
+
+		entry := MultiProofLeaf{Key: key, Exists: false}
+		if predLeaf != nil {
+			entry.Pred = newLeafRef(predLeaf, predPath, predDirs)
+		}
+		if succLeaf != nil {
+			entry.Succ = newLeafRef(succLeaf, succPath, succDirs)
+		}
+		proof.Leaves[i] = entry
+	}
+
+	return values, proof, nil
+}
+
+func newLeafRef(node *IAVLNode, path []int, dirs []bool) *MultiProofLeafRef {
+	return &MultiProofLeafRef{
+		Key:        node.key,
+		Value:      node.value,
+		Version:    node.version,
+		Path:       path,
+		Directions: dirs,
+	}
+}
+
+// recordInnerNode gives node a stable index within proof.InnerNodes,
+// deduplicated by node hash, and appends path/dirs with the step taken.
+func recordInnerNode(node *IAVLNode, left bool, nodeIndex map[string]int, proof *MultiKeyProof, path []int, dirs []bool) ([]int, []bool) {
+	idx, ok := nodeIndex[string(node.hash)]
+	if !ok {
+		idx = len(proof.InnerNodes)
+		nodeIndex[string(node.hash)] = idx
+		proof.InnerNodes = append(proof.InnerNodes, MultiProofInnerNode{
+			Height:  node.height,
+			Size:    node.size,
+			Version: node.version,
+			Left:    node.leftHash,
+			Right:   node.rightHash,
+		})
+	}
+	return append(path, idx), append(dirs, left)
+}
+
+func loadIAVLChildNode(ndb *nodeDB, child *IAVLNode, hash []byte) *IAVLNode {
+	if child != nil {
+		return child
+	}
+	if len(hash) == 0 {
+		return nil
+	}
+	return ndb.GetNode(hash)
+}
+
+// searchExact walks the tree from root to the leaf for key, appending any
+// not-yet-seen inner node it passes through to proof.InnerNodes. It returns
+// the leaf only if its key exactly matches; otherwise it returns nil (the
+// caller falls back to predecessor/successor to prove absence).
+func searchExact(t *IAVLTree, key []byte, nodeIndex map[string]int, proof *MultiKeyProof) (leaf *IAVLNode, path []int, dirs []bool) {
+	node := t.root
+
+	for node != nil {
+		if node.height == 0 {
+			if bytes.Equal(node.key, key) {
+				return node, path, dirs
+			}
+			return nil, nil, nil
+		}
+
+		left := bytes.Compare(key, node.key) < 0
+		path, dirs = recordInnerNode(node, left, nodeIndex, proof, path, dirs)
+
+		if left {
+			node = loadIAVLChildNode(t.ndb, node.leftNode, node.leftHash)
+		} else {
+			node = loadIAVLChildNode(t.ndb, node.rightNode, node.rightHash)
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// predecessor returns the largest leaf with key strictly less than key,
+// along with the path/directions authenticating it, or nil if no such leaf
+// exists (key is less than or equal to every key in the tree).
+//
+// At every inner node, node.key is by construction the smallest key in its
+// right subtree. So if key <= node.key, the right subtree is entirely >=
+// key and cannot contain the predecessor; recurse left. Otherwise node.key <
+// key, which guarantees the right subtree's own minimum (node.key) already
+// qualifies, so the predecessor is somewhere in the right subtree; recurse
+// there.
+func predecessor(ndb *nodeDB, node *IAVLNode, key []byte, nodeIndex map[string]int, proof *MultiKeyProof) (*IAVLNode, []int, []bool) {
+	return predecessorFrom(ndb, node, key, nodeIndex, proof, nil, nil)
+}
+
+func predecessorFrom(ndb *nodeDB, node *IAVLNode, key []byte, nodeIndex map[string]int, proof *MultiKeyProof, path []int, dirs []bool) (*IAVLNode, []int, []bool) {
+	if node == nil {
+		return nil, nil, nil
+	}
+	if node.height == 0 {
+		if bytes.Compare(node.key, key) < 0 {
+			return node, path, dirs
+		}
+		return nil, nil, nil
+	}
+
+	if bytes.Compare(key, node.key) <= 0 {
+		p, d := recordInnerNode(node, true, nodeIndex, proof, path, dirs)
+		return predecessorFrom(ndb, loadIAVLChildNode(ndb, node.leftNode, node.leftHash), key, nodeIndex, proof, p, d)
+	}
+
+	p, d := recordInnerNode(node, false, nodeIndex, proof, path, dirs)
+	return predecessorFrom(ndb, loadIAVLChildNode(ndb, node.rightNode, node.rightHash), key, nodeIndex, proof, p, d)
+}
+
+// successor returns the smallest leaf with key greater than or equal to key,
+// along with the path/directions authenticating it, or nil if no such leaf
+// exists (key is greater than every key in the tree).
+func successor(ndb *nodeDB, node *IAVLNode, key []byte, nodeIndex map[string]int, proof *MultiKeyProof) (*IAVLNode, []int, []bool) {
+	return successorFrom(ndb, node, key, nodeIndex, proof, nil, nil)
+}
+
+func successorFrom(ndb *nodeDB, node *IAVLNode, key []byte, nodeIndex map[string]int, proof *MultiKeyProof, path []int, dirs []bool) (*IAVLNode, []int, []bool) {
+	if node == nil {
+		return nil, nil, nil
+	}
+	if node.height == 0 {
+		if bytes.Compare(node.key, key) >= 0 {
+			return node, path, dirs
+		}
+		return nil, nil, nil
+	}
+
+	if bytes.Compare(key, node.key) <= 0 {
+		p, d := recordInnerNode(node, true, nodeIndex, proof, path, dirs)
+		if leaf, lp, ld := successorFrom(ndb, loadIAVLChildNode(ndb, node.leftNode, node.leftHash), key, nodeIndex, proof, p, d); leaf != nil {
+			return leaf, lp, ld
+		}
+		// The left subtree has nothing >= key, so the answer is the
+		// leftmost (minimum) leaf of the right subtree, which by
+		// construction has key == node.key.
+		return leftmostLeaf(ndb, loadIAVLChildNode(ndb, node.rightNode, node.rightHash), nodeIndex, proof, p, d)
+	}
+
+	p, d := recordInnerNode(node, false, nodeIndex, proof, path, dirs)
+	return successorFrom(ndb, loadIAVLChildNode(ndb, node.rightNode, node.rightHash), key, nodeIndex, proof, p, d)
+}
+
+// leftmostLeaf descends left until it reaches a leaf, recording the path.
+func leftmostLeaf(ndb *nodeDB, node *IAVLNode, nodeIndex map[string]int, proof *MultiKeyProof, path []int, dirs []bool) (*IAVLNode, []int, []bool) {
+	for node != nil && node.height > 0 {
+		path, dirs = recordInnerNode(node, true, nodeIndex, proof, path, dirs)
+		node = loadIAVLChildNode(ndb, node.leftNode, node.leftHash)
+	}
+	return node, path, dirs
+}
+
+// hashLeafNode computes the hash of a leaf node: H(height=0, size=1,
+// version, key, hash(value)). This must match the tree's own leaf hashing
+// exactly for Verify to be meaningful against a real RootHash.
+func hashLeafNode(version uint64, key, value []byte) []byte {
+	h := sha256.New()
+	writeHashInt8(h, 0)
+	writeHashInt64(h, 1)
+	writeHashUint64(h, version)
+	writeHashBytes(h, key)
+	valueHash := sha256.Sum256(value)
+	writeHashBytes(h, valueHash[:])
+	return h.Sum(nil)
+}
+
+// hashInnerNode computes the hash of an inner node: H(height, size,
+// version, left, right).
+func hashInnerNode(n MultiProofInnerNode) []byte {
+	h := sha256.New()
+	writeHashInt8(h, n.Height)
+	writeHashInt64(h, n.Size)
+	writeHashUint64(h, n.Version)
+	writeHashBytes(h, n.Left)
+	writeHashBytes(h, n.Right)
+	return h.Sum(nil)
+}
+
+func writeHashInt8(h interface{ Write([]byte) (int, error) }, v int8) {
+	h.Write([]byte{byte(v)})
+}
+
+func writeHashInt64(h interface{ Write([]byte) (int, error) }, v int64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	h.Write(buf[:])
+}
+
+func writeHashUint64(h interface{ Write([]byte) (int, error) }, v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	h.Write(buf[:])
+}
+
+func writeHashBytes(h interface{ Write([]byte) (int, error) }, b []byte) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(len(b)))
+	h.Write(buf[:])
+	h.Write(b)
+}
+
+// chainToRoot recomputes ref's leaf hash and folds it up through the inner
+// nodes named by ref.Path (in root-to-leaf order), returning the resulting
+// root hash.
+func chainToRoot(proof *MultiKeyProof, ref *MultiProofLeafRef) ([]byte, error) {
+	child := hashLeafNode(ref.Version, ref.Key, ref.Value)
+
+	for i := len(ref.Path) - 1; i >= 0; i-- {
+		if ref.Path[i] < 0 || ref.Path[i] >= len(proof.InnerNodes) {
+			return nil, errors.Errorf("path index %d out of range", ref.Path[i])
+		}
+		inner := proof.InnerNodes[ref.Path[i]]
+
+		var want []byte
+		if ref.Directions[i] {
+			want = inner.Left
+		} else {
+			want = inner.Right
+		}
+		if !bytes.Equal(child, want) {
+			return nil, errors.New("leaf/inner hash does not match recorded child hash")
+		}
+
+		child = hashInnerNode(inner)
+	}
+
+	return child, nil
+}
+
+// Verify checks that proof authenticates the presence or absence of every
+// key it describes against proof.RootHash.
+func (proof *MultiKeyProof) Verify() error {
+	for _, leaf := range proof.Leaves {
+		if leaf.Exists {
+			if leaf.Leaf == nil {
+				return errors.New("leaf marked Exists but has no Leaf reference")
+			}
+			root, err := chainToRoot(proof, leaf.Leaf)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(root, proof.RootHash) {
+				return errors.Errorf("key %x: leaf does not chain to root hash", leaf.Key)
+			}
+			continue
+		}
+
+		if err := verifyAbsence(proof, leaf); err != nil {
+			return errors.Wrapf(err, "key %x", leaf.Key)
+		}
+	}
+	return nil
+}
+
+// verifyAbsence checks a single non-membership entry: both neighbors (that
+// exist) must chain to the root, must actually bracket Key, and - the part
+// that rules out a neighbor skipping over the real key entirely - must be
+// tree-adjacent to one another (or to the edge of the tree, if only one
+// neighbor exists).
+func verifyAbsence(proof *MultiKeyProof, leaf MultiProofLeaf) error {
+	if leaf.Pred == nil && leaf.Succ == nil {
+		if len(proof.RootHash) != 0 {
+			return errors.New("absence of a key requires at least one neighboring leaf in a non-empty tree")
+		}
+		return nil
+	}
+
+	if leaf.Pred != nil {
+		if bytes.Compare(leaf.Pred.Key, leaf.Key) >= 0 {
+			return errors.New("predecessor key is not strictly less than the queried key")
+		}
+		root, err := chainToRoot(proof, leaf.Pred)
+		if err != nil {
+			return errors.Wrap(err, "predecessor")
+		}
+		if !bytes.Equal(root, proof.RootHash) {
+			return errors.New("predecessor does not chain to root hash")
+		}
+	}
+	if leaf.Succ != nil {
+		if bytes.Compare(leaf.Succ.Key, leaf.Key) <= 0 {
+			return errors.New("successor key is not strictly greater than the queried key")
+		}
+		root, err := chainToRoot(proof, leaf.Succ)
+		if err != nil {
+			return errors.Wrap(err, "successor")
+		}
+		if !bytes.Equal(root, proof.RootHash) {
+			return errors.New("successor does not chain to root hash")
+		}
+	}
+
+	switch {
+	case leaf.Pred == nil:
+		// No predecessor: succ must be the global minimum leaf, i.e. reached
+		// by taking "left" at every step from the root.
+		for _, d := range leaf.Succ.Directions {
+			if !d {
+				return errors.New("successor is not the tree's minimum leaf")
+			}
+		}
+	case leaf.Succ == nil:
+		// No successor: pred must be the global maximum leaf, i.e. reached
+		// by taking "right" at every step from the root.
+		for _, d := range leaf.Pred.Directions {
+			if d {
+				return errors.New("predecessor is not the tree's maximum leaf")
+			}
+		}
+	default:
+		return verifyAdjacent(leaf.Pred, leaf.Succ)
+	}
+	return nil
+}
+
+// verifyAdjacent checks that pred and succ are in-order adjacent leaves:
+// their paths must share a common prefix down to a lowest common ancestor,
+// where pred takes the left child and succ the right child, after which
+// pred must always go right (to reach the rightmost leaf of that left
+// subtree) and succ must always go left (to reach the leftmost leaf of that
+// right subtree). This is exactly the condition under which no leaf can sit
+// between them.
+func verifyAdjacent(pred, succ *MultiProofLeafRef) error {
+	common := 0
+	for common < len(pred.Path) && common < len(succ.Path) && pred.Path[common] == succ.Path[common] {
+		common++
+	}
+	if common == 0 {
+		return errors.New("predecessor and successor share no common ancestor")
+	}
+	if common > len(pred.Directions) || common > len(succ.Directions) {
+		return errors.New("malformed proof: one of predecessor/successor is an ancestor of the other")
+	}
+
+	lca := common - 1
+	if !pred.Directions[lca] {
+		return errors.New("predecessor does not descend left from the common ancestor")
+	}
+	if succ.Directions[lca] {
+		return errors.New("successor does not descend right from the common ancestor")
+	}
+
+	for i := lca + 1; i < len(pred.Directions); i++ {
+		if pred.Directions[i] {
+			return errors.New("predecessor is not the rightmost leaf below the common ancestor")
+		}
+	}
+	for i := lca + 1; i < len(succ.Directions); i++ {
+		if !succ.Directions[i] {
+			return errors.New("successor is not the leftmost leaf below the common ancestor")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tmlibs/db"
+)
+
+func setAndSave(t *testing.T, tree *VersionedTree, version uint64) {
+	tree.Set([]byte{byte(version)}, []byte{byte(version)})
+	_, err := tree.SaveVersion(version)
+	require.NoError(t, err)
+}
+
+func TestPruning_KeepRecentZero(t *testing.T) {
+	tree := NewVersionedTreeWithPruning(0, dbm.NewMemDB(), 0, 0)
+
+	for v := uint64(1); v <= 5; v++ {
+		setAndSave(t, tree, v)
+	}
+
+	// With keepRecent == 0 and keepEvery == 0, only the latest version
+	// survives.
+	for v := uint64(1); v < 5; v++ {
+		require.False(t, tree.VersionExists(v), "version %d should have been pruned", v)
+	}
+	require.True(t, tree.VersionExists(5))
+}
+
+func TestPruning_KeepEveryZero(t *testing.T) {
+	tree := NewVersionedTreeWithPruning(0, dbm.NewMemDB(), 2, 0)
+
+	for v := uint64(1); v <= 5; v++ {
+		setAndSave(t, tree, v)
+	}
+
+	// With keepEvery == 0 there are no waypoints: only the recent window
+	// [latest-keepRecent+1, latest] survives.
+	require.False(t, tree.VersionExists(1))
+	require.False(t, tree.VersionExists(2))
+	require.False(t, tree.VersionExists(3))
+	require.True(t, tree.VersionExists(4))
+	require.True(t, tree.VersionExists(5))
+}
+
+func TestPruning_WaypointsSurviveOutsideWindow(t *testing.T) {
+	tree := NewVersionedTreeWithPruning(0, dbm.NewMemDB(), 1, 3)
+
+	for v := uint64(1); v <= 7; v++ {
+		setAndSave(t, tree, v)
+	}
+
+	// Waypoints (version % 3 == 0) are kept even outside the recent window.
+	require.True(t, tree.VersionExists(3))
+	require.True(t, tree.VersionExists(6))
+	// Non-waypoints outside the window are pruned.
+	require.False(t, tree.VersionExists(1))
+	require.False(t, tree.VersionExists(2))
+	require.False(t, tree.VersionExists(4))
+	require.False(t, tree.VersionExists(5))
+	// The latest version always survives.
+	require.True(t, tree.VersionExists(7))
+}
+
+func TestPruning_DeleteVersionOnAlreadyPrunedVersion(t *testing.T) {
+	tree := NewVersionedTreeWithPruning(0, dbm.NewMemDB(), 0, 0)
+
+	for v := uint64(1); v <= 3; v++ {
+		setAndSave(t, tree, v)
+	}
+	require.False(t, tree.VersionExists(1))
+
+	// Deleting a version that pruning already removed should behave like
+	// deleting any other version that was never saved.
+	err := tree.DeleteVersion(1)
+	require.Error(t, err)
+	require.Equal(t, ErrVersionDoesNotExist, errors.Cause(err))
+}